@@ -0,0 +1,79 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mod
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/internal/lsp/source"
+)
+
+// tidiedModfileFallback produces the tidied go.mod file for realfh without
+// relying on the -modfile flag, for use on Go versions before 1.14. It
+// copies the module to a scratch directory and runs `go mod tidy` there, so
+// that the user's real go.mod and go.sum are never touched.
+func tidiedModfileFallback(ctx context.Context, snapshot source.Snapshot, realfh source.FileHandle) (*modfile.File, error) {
+	tmpDir, err := ioutil.TempDir("", "gopls-modfile-fallback")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := copyModuleToTempDir(filepath.Dir(realfh.URI().Filename()), tmpDir); err != nil {
+		return nil, err
+	}
+	env := snapshot.View().Options().Env
+	if err := runGoCommand(ctx, tmpDir, env, "mod", "tidy"); err != nil {
+		return nil, err
+	}
+	tidiedContents, err := ioutil.ReadFile(filepath.Join(tmpDir, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	return modfile.Parse("go.mod", tidiedContents, nil)
+}
+
+// runGoCommand runs the go command with the given arguments in dir.
+func runGoCommand(ctx context.Context, dir string, env []string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	_, err := cmd.Output()
+	return err
+}
+
+// copyModuleToTempDir recursively copies the module rooted at src into dst,
+// skipping the vendor directory and version control metadata.
+func copyModuleToTempDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if info.IsDir() {
+			switch filepath.Base(rel) {
+			case "vendor", ".git":
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, rel), contents, info.Mode())
+	})
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mod
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/internal/lsp/protocol"
+	"golang.org/x/tools/internal/lsp/source"
+	"golang.org/x/tools/internal/span"
+)
+
+// importRe matches a single quoted import path.
+var importRe = regexp.MustCompile(`"([^"]+)"`)
+
+// missingDependencyDiagnostics finds the go.mod requires that `go mod tidy`
+// would add -- because some .go file in the module imports them, but
+// they're missing from go.mod -- and reports a diagnostic on each such
+// import, keyed by the FileHandle of the .go file it appears in. The
+// corresponding go.mod edit that adds the require is surfaced by
+// SuggestedFixes, which resolves the version to add via
+// missingRequireVersion.
+func missingDependencyDiagnostics(ctx context.Context, snapshot source.Snapshot, realfh source.FileHandle, parsed, tidied *modfile.File) (map[source.FileHandle][]source.Diagnostic, error) {
+	missing := make(map[string]*modfile.Require)
+	for _, req := range tidied.Require {
+		if !hasRequire(parsed, req.Mod.Path) {
+			missing[req.Mod.Path] = req
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	reports := make(map[source.FileHandle][]source.Diagnostic)
+	root := filepath.Dir(realfh.URI().Filename())
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			switch filepath.Base(path) {
+			case "vendor", "testdata", ".git":
+				return filepath.SkipDir
+			}
+			// A subdirectory with its own go.mod is the root of a nested
+			// module; its .go files are diagnosed separately when we
+			// process that go.mod, so don't attribute their imports to
+			// this one.
+			if path != root {
+				if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".go" {
+			return nil
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		diagnostics := missingImportDiagnostics(contents, missing)
+		if len(diagnostics) == 0 {
+			return nil
+		}
+		fh, err := snapshot.GetFile(ctx, span.FileURI(path))
+		if err != nil {
+			return err
+		}
+		reports[fh] = append(reports[fh], diagnostics...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// missingImportDiagnostics scans a single Go file's contents for imports
+// rooted at one of the missing module paths and returns a diagnostic for
+// each, with Range covering the quoted import path.
+func missingImportDiagnostics(contents []byte, missing map[string]*modfile.Require) []source.Diagnostic {
+	var diagnostics []source.Diagnostic
+	inImport := false
+	for i, line := range strings.Split(string(contents), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "import ("):
+			inImport = true
+			continue
+		case inImport && trimmed == ")":
+			inImport = false
+			continue
+		case !inImport && !strings.HasPrefix(trimmed, "import "):
+			continue
+		}
+		loc := importRe.FindStringSubmatchIndex(line)
+		if loc == nil {
+			continue
+		}
+		importPath := line[loc[2]:loc[3]]
+		modPath := moduleForImport(importPath, missing)
+		if modPath == "" {
+			continue
+		}
+		diagnostics = append(diagnostics, source.Diagnostic{
+			Message: fmt.Sprintf("%s is not in your go.mod file.", modPath),
+			Source:  "go mod tidy",
+			Range: protocol.Range{
+				Start: protocol.Position{Line: float64(i), Character: float64(loc[2])},
+				End:   protocol.Position{Line: float64(i), Character: float64(loc[3])},
+			},
+			Severity: protocol.SeverityWarning,
+		})
+	}
+	return diagnostics
+}
+
+// moduleForImport returns the module path in missing that importPath is
+// part of, or "" if importPath isn't rooted at any of them.
+func moduleForImport(importPath string, missing map[string]*modfile.Require) string {
+	for modPath := range missing {
+		if importPath == modPath || strings.HasPrefix(importPath, modPath+"/") {
+			return modPath
+		}
+	}
+	return ""
+}
+
+// missingRequireVersion resolves the version to use for a newly added
+// require satisfying a missing import. It prefers the version
+// `go list -m -json <path>@latest` reports, matching what `go get` would
+// choose, and falls back to whatever version `go mod tidy` picked if that
+// lookup fails (for example because the module can't be resolved over the
+// network in the fallback path's scratch directory).
+func missingRequireVersion(ctx context.Context, snapshot source.Snapshot, path string, loadTidiedRequires func() (map[string]*modfile.Require, error)) (string, error) {
+	env := snapshot.View().Options().Env
+	if version, err := latestModuleVersion(ctx, env, path); err == nil {
+		return version, nil
+	}
+	tidiedRequires, err := loadTidiedRequires()
+	if err != nil {
+		return "", err
+	}
+	req, ok := tidiedRequires[path]
+	if !ok {
+		return "", fmt.Errorf("cannot determine a version for missing dependency %s", path)
+	}
+	return req.Mod.Version, nil
+}
+
+// latestModuleVersion returns the version of path that `go get` would
+// choose to satisfy a missing import, i.e. what
+// `go list -m -json <path>@latest` reports.
+func latestModuleVersion(ctx context.Context, env []string, path string) (string, error) {
+	cmd := exec.CommandContext(ctx, "go", "list", "-m", "-json", path+"@latest")
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	var m struct{ Version string }
+	if err := json.Unmarshal(out, &m); err != nil {
+		return "", err
+	}
+	return m.Version, nil
+}
@@ -0,0 +1,440 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mod provides core features related to go.mod file
+// handling for use by Go editors and tools.
+package mod
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/internal/lsp/protocol"
+	"golang.org/x/tools/internal/lsp/source"
+	"golang.org/x/tools/internal/span"
+)
+
+// Diagnostics returns diagnostics for every go.mod file discovered beneath
+// the workspace root, keyed by the FileIdentity of the file (a go.mod or a
+// .go file) the diagnostic applies to. Workspaces containing more than one
+// module -- for example a multi-module repository, or a module with nested
+// submodules -- are diagnosed independently: a require in one go.mod never
+// produces a diagnostic attributed to, or suppressed by, another.
+//
+// For each go.mod, it first checks the file for syntax errors. If there are
+// any, it does not go further for that module, since a go.mod file with
+// syntax errors cannot be tidied. Otherwise, it diffs the go.mod file
+// against the result of `go mod tidy` to find unused and
+// incorrectly-marked-indirect requires, as well as imports in the module's
+// .go files that aren't yet satisfied by a require (in which case the
+// diagnostic is reported on the offending import, not on go.mod).
+//
+// On Go versions before 1.14, the -modfile flag doesn't exist, so
+// snapshot.TempModFile returns a nil handle for a given go.mod. In that
+// case, we fall back to running `go mod tidy` in a scratch copy of that
+// module so that the user's real go.mod is never written to.
+func Diagnostics(ctx context.Context, snapshot source.Snapshot) (map[source.FileIdentity][]source.Diagnostic, error) {
+	realfhs, err := snapshot.ModFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reports := make(map[source.FileIdentity][]source.Diagnostic)
+	for _, realfh := range realfhs {
+		if err := diagnoseModfile(ctx, snapshot, realfh, reports); err != nil {
+			return nil, err
+		}
+	}
+	return reports, nil
+}
+
+// diagnoseModfile diagnoses a single go.mod, adding its results (and those
+// of any .go files whose missing imports it explains) into reports.
+func diagnoseModfile(ctx context.Context, snapshot source.Snapshot, realfh source.FileHandle, reports map[source.FileIdentity][]source.Diagnostic) error {
+	identity := realfh.Identity()
+	if _, ok := reports[identity]; !ok {
+		reports[identity] = []source.Diagnostic{}
+	}
+
+	contents, err := realfh.Read()
+	if err != nil {
+		return err
+	}
+	parsed, parseErr := modfile.Parse(realfh.URI().Filename(), contents, nil)
+	if parseErr != nil {
+		diag, err := parseErrorDiagnostic(contents, parseErr)
+		if err != nil {
+			return err
+		}
+		reports[identity] = append(reports[identity], diag)
+		return nil
+	}
+
+	tempfh, err := snapshot.TempModFile(ctx, realfh)
+	if err != nil {
+		return err
+	}
+	tidied, err := tidiedModfile(ctx, snapshot, realfh, tempfh)
+	if err != nil {
+		return err
+	}
+	reports[identity] = append(reports[identity], tidyDiagnostics(parsed, tidied)...)
+
+	missingReports, err := missingDependencyDiagnostics(ctx, snapshot, realfh, parsed, tidied)
+	if err != nil {
+		return err
+	}
+	for fh, diagnostics := range missingReports {
+		reports[fh.Identity()] = append(reports[fh.Identity()], diagnostics...)
+	}
+	return nil
+}
+
+// tidiedModfile returns the parsed go.mod file that `go mod tidy` would
+// produce for realfh. When tempfh is non-nil, the snapshot's ModTidyHandle
+// (backed by -modfile) is used; otherwise we fall back to running `go mod
+// tidy` in a scratch copy of the module.
+func tidiedModfile(ctx context.Context, snapshot source.Snapshot, realfh, tempfh source.FileHandle) (*modfile.File, error) {
+	if tempfh == nil {
+		return tidiedModfileFallback(ctx, snapshot, realfh)
+	}
+	tidyHandle, err := snapshot.ModTidyHandle(ctx, realfh)
+	if err != nil {
+		return nil, err
+	}
+	tidied, err := tidyHandle.Tidy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tidied.Parsed, nil
+}
+
+// parseErrorRe matches the errors returned by modfile.Parse, which are of
+// the form "<filename>:<line>: <message>".
+var parseErrorRe = regexp.MustCompile(`^.*:(\d+): (.+)$`)
+
+// parseErrorDiagnostic turns a modfile.Parse error into a diagnostic. The
+// range covers the offending line with its leading and trailing whitespace
+// trimmed, which is as close as we can get without position information
+// from the modfile package itself.
+func parseErrorDiagnostic(contents []byte, parseErr error) (source.Diagnostic, error) {
+	matches := parseErrorRe.FindStringSubmatch(parseErr.Error())
+	if len(matches) < 3 {
+		return source.Diagnostic{}, fmt.Errorf("could not parse go.mod error message: %s", parseErr)
+	}
+	lineNum, message := matches[1], matches[2]
+	var n int
+	if _, err := fmt.Sscanf(lineNum, "%d", &n); err != nil {
+		return source.Diagnostic{}, err
+	}
+	lines := strings.Split(string(contents), "\n")
+	if n < 1 || n > len(lines) {
+		return source.Diagnostic{}, fmt.Errorf("invalid line number %d in go.mod error: %s", n, parseErr)
+	}
+	line := lines[n-1]
+	return source.Diagnostic{
+		Message:  message,
+		Range:    tokenRange(n-1, line),
+		Severity: protocol.SeverityError,
+		Source:   "syntax",
+	}, nil
+}
+
+// tokenRange returns the range covering the non-whitespace contents of the
+// given (0-indexed) line.
+func tokenRange(line int, text string) protocol.Range {
+	trimmedLeft := strings.TrimLeft(text, " \t")
+	start := len(text) - len(trimmedLeft)
+	trimmed := strings.TrimRight(trimmedLeft, " \t\r")
+	return protocol.Range{
+		Start: protocol.Position{Line: float64(line), Character: float64(start)},
+		End:   protocol.Position{Line: float64(line), Character: float64(start + len(trimmed))},
+	}
+}
+
+// tidyDiagnostics compares the parsed go.mod file against the tidied
+// version, reporting a diagnostic for each require that go mod tidy would
+// drop (unused) or whose indirect marking it would flip (miscategorized).
+func tidyDiagnostics(parsed, tidied *modfile.File) []source.Diagnostic {
+	tidiedRequires := make(map[string]*modfile.Require)
+	for _, req := range tidied.Require {
+		tidiedRequires[req.Mod.Path] = req
+	}
+
+	var diagnostics []source.Diagnostic
+	for _, req := range parsed.Require {
+		tidiedReq, ok := tidiedRequires[req.Mod.Path]
+		if !ok {
+			diagnostics = append(diagnostics, unusedDiagnostic(req))
+			continue
+		}
+		if req.Indirect != tidiedReq.Indirect {
+			diagnostics = append(diagnostics, indirectDiagnostic(req, tidiedReq.Indirect))
+		}
+	}
+	return diagnostics
+}
+
+func unusedDiagnostic(req *modfile.Require) source.Diagnostic {
+	return source.Diagnostic{
+		Message:  fmt.Sprintf("%s is not used in this module.", req.Mod.Path),
+		Range:    rangeForRequire(req),
+		Severity: protocol.SeverityWarning,
+		Source:   "go mod tidy",
+	}
+}
+
+func indirectDiagnostic(req *modfile.Require, wantIndirect bool) source.Diagnostic {
+	msg := fmt.Sprintf("%s should not be an indirect dependency.", req.Mod.Path)
+	if wantIndirect {
+		msg = fmt.Sprintf("%s should be an indirect dependency.", req.Mod.Path)
+	}
+	return source.Diagnostic{
+		Message:  msg,
+		Range:    rangeForRequire(req),
+		Severity: protocol.SeverityWarning,
+		Source:   "go mod tidy",
+	}
+}
+
+// rangeForRequire returns the range of the require statement itself,
+// excluding any trailing line comment (such as "// indirect").
+func rangeForRequire(req *modfile.Require) protocol.Range {
+	start := req.Syntax.Start
+	end := req.Syntax.End
+	return protocol.Range{
+		Start: protocol.Position{Line: float64(start.Line - 1), Character: float64(start.LineRune - 1)},
+		End:   protocol.Position{Line: float64(end.Line - 1), Character: float64(end.LineRune - 1)},
+	}
+}
+
+// fixKind identifies the edit SuggestedFixes should make for a go.mod
+// diagnostic it's been handed.
+type fixKind int
+
+const (
+	fixDropRequire fixKind = iota
+	fixFlipIndirect
+	fixAddRequire
+)
+
+// These match the Message strings built by unusedDiagnostic, indirectDiagnostic
+// and missingImportDiagnostics respectively.
+var (
+	unusedDiagnosticRe   = regexp.MustCompile(`^(\S+) is not used in this module\.$`)
+	indirectDiagnosticRe = regexp.MustCompile(`^(\S+) should (?:not )?be an indirect dependency\.$`)
+	missingDiagnosticRe  = regexp.MustCompile(`^(\S+) is not in your go\.mod file\.$`)
+)
+
+// diagnosedFix reports the module path and kind of fix that a diagnostic
+// produced by this package asks for, so that SuggestedFixes can scope its
+// edits to exactly the diagnostics it's been handed instead of recomputing
+// every difference between go.mod and its tidied form. ok is false for
+// diagnostics this package didn't produce, such as a syntax error.
+func diagnosedFix(d source.Diagnostic) (path string, kind fixKind, ok bool) {
+	if m := unusedDiagnosticRe.FindStringSubmatch(d.Message); m != nil {
+		return m[1], fixDropRequire, true
+	}
+	if m := indirectDiagnosticRe.FindStringSubmatch(d.Message); m != nil {
+		return m[1], fixFlipIndirect, true
+	}
+	if m := missingDiagnosticRe.FindStringSubmatch(d.Message); m != nil {
+		return m[1], fixAddRequire, true
+	}
+	return "", 0, false
+}
+
+// SuggestedFixes computes the text edits that resolve the given diagnostics
+// -- which must all have been produced by Diagnostics for realfh, one of the
+// go.mod files returned by snapshot.ModFiles -- against what `go mod tidy`
+// produces for it. Only the requires named by diagnostics are touched; a
+// CodeAction invoked on a single "unused" warning, for example, does not
+// also flip unrelated indirect markings.
+func SuggestedFixes(ctx context.Context, snapshot source.Snapshot, realfh source.FileHandle, diagnostics []source.Diagnostic) (map[span.URI][]protocol.TextEdit, error) {
+	contents, err := realfh.Read()
+	if err != nil {
+		return nil, err
+	}
+	// Parse fresh so we can mutate in place without touching the snapshot's
+	// cached result.
+	fixed, err := modfile.Parse(realfh.URI().Filename(), contents, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var tidiedRequires map[string]*modfile.Require
+	loadTidiedRequires := func() (map[string]*modfile.Require, error) {
+		if tidiedRequires != nil {
+			return tidiedRequires, nil
+		}
+		tempfh, err := snapshot.TempModFile(ctx, realfh)
+		if err != nil {
+			return nil, err
+		}
+		tidied, err := tidiedModfile(ctx, snapshot, realfh, tempfh)
+		if err != nil {
+			return nil, err
+		}
+		tidiedRequires = make(map[string]*modfile.Require)
+		for _, req := range tidied.Require {
+			tidiedRequires[req.Mod.Path] = req
+		}
+		return tidiedRequires, nil
+	}
+
+	var changed, indirectChanged bool
+	seen := make(map[fixKind]map[string]bool)
+	for _, d := range diagnostics {
+		path, kind, ok := diagnosedFix(d)
+		if !ok {
+			continue
+		}
+		if seen[kind] == nil {
+			seen[kind] = make(map[string]bool)
+		}
+		if seen[kind][path] {
+			continue
+		}
+		seen[kind][path] = true
+
+		switch kind {
+		case fixDropRequire:
+			if !hasRequire(fixed, path) {
+				continue
+			}
+			if err := fixed.DropRequire(path); err != nil {
+				return nil, err
+			}
+			changed = true
+		case fixFlipIndirect:
+			tidiedRequires, err := loadTidiedRequires()
+			if err != nil {
+				return nil, err
+			}
+			tidiedReq, ok := tidiedRequires[path]
+			if !ok {
+				continue
+			}
+			for _, req := range fixed.Require {
+				if req.Mod.Path != path {
+					continue
+				}
+				// Flip the indirect marking in place on the existing
+				// Require node, rather than dropping and re-adding it, so
+				// the require keeps its original position among its
+				// siblings once SetRequire (below) rewrites the block.
+				req.Indirect = tidiedReq.Indirect
+				indirectChanged = true
+				changed = true
+			}
+		case fixAddRequire:
+			if hasRequire(fixed, path) {
+				continue
+			}
+			version, err := missingRequireVersion(ctx, snapshot, path, loadTidiedRequires)
+			if err != nil {
+				return nil, err
+			}
+			if err := fixed.AddRequire(path, version); err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+	}
+	if indirectChanged {
+		fixed.SetRequire(fixed.Require)
+	}
+	if !changed {
+		return nil, nil
+	}
+	fixed.Cleanup()
+	newContents, err := fixed.Format()
+	if err != nil {
+		return nil, err
+	}
+	edits := computeEdits(string(contents), string(newContents))
+	if edits == nil {
+		return nil, nil
+	}
+	return map[span.URI][]protocol.TextEdit{
+		realfh.URI(): edits,
+	}, nil
+}
+
+func hasRequire(f *modfile.File, path string) bool {
+	for _, req := range f.Require {
+		if req.Mod.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// computeEdits produces a single text edit covering the lines that changed
+// between before and after, trimming off their common leading and trailing
+// lines first. The modfile package does not expose a diff API, so this is
+// not a general line-oriented diff, but it's enough to keep an edit for a
+// single require (the common case) from touching blank lines and comments
+// elsewhere in the file.
+func computeEdits(before, after string) []protocol.TextEdit {
+	if before == after {
+		return nil
+	}
+	beforeLines := strings.Split(before, "\n")
+	afterLines := strings.Split(after, "\n")
+
+	start := 0
+	for start < len(beforeLines) && start < len(afterLines) && beforeLines[start] == afterLines[start] {
+		start++
+	}
+	endBefore, endAfter := len(beforeLines), len(afterLines)
+	for endBefore > start && endAfter > start && beforeLines[endBefore-1] == afterLines[endAfter-1] {
+		endBefore--
+		endAfter--
+	}
+	// When nothing replaces the changed lines (a dropped require, say), the
+	// edit is a pure deletion and must not leave an empty line behind.
+	var newText string
+	if start < endAfter {
+		newText = strings.Join(afterLines[start:endAfter], "\n")
+		if endAfter < len(afterLines) {
+			newText += "\n"
+		}
+	}
+	return []protocol.TextEdit{{
+		Range: protocol.Range{
+			Start: protocol.Position{Line: float64(start), Character: 0},
+			End:   protocol.Position{Line: float64(endBefore), Character: 0},
+		},
+		NewText: newText,
+	}}
+}
+
+// ModForFile returns the go.mod file, among those returned by
+// snapshot.ModFiles, whose directory most closely contains uri -- that is,
+// the module uri belongs to. It returns a nil handle if uri isn't
+// underneath any known go.mod.
+func ModForFile(ctx context.Context, snapshot source.Snapshot, uri span.URI) (source.FileHandle, error) {
+	realfhs, err := snapshot.ModFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var best source.FileHandle
+	bestLen := -1
+	dir := filepath.Dir(uri.Filename())
+	for _, realfh := range realfhs {
+		modDir := filepath.Dir(realfh.URI().Filename())
+		rel, err := filepath.Rel(modDir, dir)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if len(modDir) > bestLen {
+			best, bestLen = realfh, len(modDir)
+		}
+	}
+	return best, nil
+}
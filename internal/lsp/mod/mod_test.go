@@ -11,11 +11,12 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"golang.org/x/tools/internal/lsp/cache"
 	"golang.org/x/tools/internal/lsp/mod"
-	"golang.org/x/tools/internal/lsp/protocol"
+	"golang.org/x/tools/internal/lsp/mod/modtests"
 	"golang.org/x/tools/internal/lsp/source"
 	"golang.org/x/tools/internal/lsp/tests"
 	"golang.org/x/tools/internal/span"
@@ -27,8 +28,6 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-// TODO(golang/go#36091): This file can be refactored to look like lsp_test.go
-// when marker support gets added for go.mod files.
 func TestModfileRemainsUnchanged(t *testing.T) {
 	ctx := tests.Context(t)
 	cache := cache.New(nil)
@@ -53,7 +52,8 @@ func TestModfileRemainsUnchanged(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !hasTempModfile(ctx, snapshot) {
+	realfh := soleModFile(ctx, t, snapshot)
+	if !hasTempModfile(ctx, snapshot, realfh) {
 		return
 	}
 	after, err := ioutil.ReadFile(filepath.Join(folder, "go.mod"))
@@ -65,8 +65,6 @@ func TestModfileRemainsUnchanged(t *testing.T) {
 	}
 }
 
-// TODO(golang/go#36091): This file can be refactored to look like lsp_test.go
-// when marker support gets added for go.mod files.
 func TestDiagnostics(t *testing.T) {
 	ctx := tests.Context(t)
 	cache := cache.New(nil)
@@ -75,82 +73,25 @@ func TestDiagnostics(t *testing.T) {
 	options.TempModfile = true
 	options.Env = append(os.Environ(), "GOPACKAGESDRIVER=off", "GOROOT=")
 
-	for _, tt := range []struct {
-		testdir string
-		want    []source.Diagnostic
-	}{
-		{
-			testdir: "indirect",
-			want: []source.Diagnostic{
-				{
-					Message: "golang.org/x/tools should not be an indirect dependency.",
-					Source:  "go mod tidy",
-					// TODO(golang/go#36091): When marker support gets added for go.mod files, we
-					// can remove these hard coded positions.
-					Range:    protocol.Range{Start: getPos(4, 0), End: getPos(4, 61)},
-					Severity: protocol.SeverityWarning,
-				},
-			},
-		},
-		{
-			testdir: "unused",
-			want: []source.Diagnostic{
-				{
-					Message:  "golang.org/x/tools is not used in this module.",
-					Source:   "go mod tidy",
-					Range:    protocol.Range{Start: getPos(4, 0), End: getPos(4, 61)},
-					Severity: protocol.SeverityWarning,
-				},
-			},
-		},
-		{
-			testdir: "invalidrequire",
-			want: []source.Diagnostic{
-				{
-					Message:  "usage: require module/path v1.2.3",
-					Source:   "syntax",
-					Range:    protocol.Range{Start: getPos(4, 0), End: getPos(4, 17)},
-					Severity: protocol.SeverityError,
-				},
-			},
-		},
-		{
-			testdir: "invalidgo",
-			want: []source.Diagnostic{
-				{
-					Message:  "usage: go 1.23",
-					Source:   "syntax",
-					Range:    protocol.Range{Start: getPos(2, 0), End: getPos(2, 4)},
-					Severity: protocol.SeverityError,
-				},
-			},
-		},
-		{
-			testdir: "unknowndirective",
-			want: []source.Diagnostic{
-				{
-					Message:  "unknown directive: yo",
-					Source:   "syntax",
-					Range:    protocol.Range{Start: getPos(6, 0), End: getPos(6, 2)},
-					Severity: protocol.SeverityError,
-				},
-			},
-		},
-	} {
-		t.Run(tt.testdir, func(t *testing.T) {
+	for _, testdir := range []string{"indirect", "unused", "invalidrequire", "invalidgo", "unknowndirective"} {
+		t.Run(testdir, func(t *testing.T) {
 			// Make sure to copy the test directory to a temporary directory so we do not
 			// modify the test code or add go.sum files when we run the tests.
-			folder, err := copyToTempDir(filepath.Join("testdata", tt.testdir))
+			folder, err := copyToTempDir(filepath.Join("testdata", testdir))
 			if err != nil {
 				t.Fatal(err)
 			}
 			defer os.RemoveAll(folder)
+			want, err := wantDiagnostics(folder)
+			if err != nil {
+				t.Fatal(err)
+			}
 			_, snapshot, err := session.NewView(ctx, "diagnostics_test", span.FileURI(folder), options)
 			if err != nil {
 				t.Fatal(err)
 			}
-			// TODO: Add testing for when the -modfile flag is turned off and we still get diagnostics.
-			if !hasTempModfile(ctx, snapshot) {
+			realfh := soleModFile(ctx, t, snapshot)
+			if !hasTempModfile(ctx, snapshot, realfh) {
 				return
 			}
 			reports, err := mod.Diagnostics(ctx, snapshot)
@@ -158,10 +99,130 @@ func TestDiagnostics(t *testing.T) {
 				t.Fatal(err)
 			}
 			if len(reports) != 1 {
-				t.Errorf("expected 1 fileHandle, got %d", len(reports))
+				t.Errorf("expected 1 fileIdentity, got %d", len(reports))
+			}
+			for identity, got := range reports {
+				if diff := tests.DiffDiagnostics(identity.URI, want, got); diff != "" {
+					t.Error(diff)
+				}
+			}
+		})
+	}
+}
+
+// TestNestedModules checks that a go.mod nested beneath another go.mod is
+// diagnosed independently: a require that's unused in one must not show up
+// as a diagnostic attributed to, or be masked by, the other.
+func TestNestedModules(t *testing.T) {
+	ctx := tests.Context(t)
+	cache := cache.New(nil)
+	session := cache.NewSession(ctx)
+	options := tests.DefaultOptions()
+	options.TempModfile = true
+	options.Env = append(os.Environ(), "GOPACKAGESDRIVER=off", "GOROOT=")
+
+	folder, err := copyToTempDir(filepath.Join("testdata", "nested"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	rootWant, err := wantDiagnostics(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subFolder := filepath.Join(folder, "sub")
+	subWant, err := wantDiagnostics(subFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, snapshot, err := session.NewView(ctx, "diagnostics_test", span.FileURI(folder), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err := mod.Diagnostics(ctx, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 fileIdentities (one per go.mod), got %d", len(reports))
+	}
+	for identity, got := range reports {
+		want := rootWant
+		if identity.URI.Filename() == filepath.Join(subFolder, "go.mod") {
+			want = subWant
+		}
+		if diff := tests.DiffDiagnostics(identity.URI, want, got); diff != "" {
+			t.Error(diff)
+		}
+	}
+}
+
+// wantDiagnostics reads the //@diag(...) markers out of folder's go.mod and
+// converts them into the source.Diagnostic values mod.Diagnostics is
+// expected to produce.
+func wantDiagnostics(folder string) ([]source.Diagnostic, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(folder, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	markers, _, err := modtests.Parse(contents)
+	if err != nil {
+		return nil, err
+	}
+	var want []source.Diagnostic
+	for _, m := range markers {
+		want = append(want, source.Diagnostic{
+			Message:  m.Message,
+			Source:   m.Source,
+			Range:    m.Range,
+			Severity: m.Severity,
+		})
+	}
+	return want, nil
+}
+
+// TestDiagnosticsWithoutModfile exercises the fallback path used on Go
+// versions that don't support the -modfile flag (before Go 1.14), where
+// mod.Diagnostics must shell out to `go mod tidy` in a scratch directory
+// rather than relying on a temp modfile.
+func TestDiagnosticsWithoutModfile(t *testing.T) {
+	ctx := tests.Context(t)
+	cache := cache.New(nil)
+	session := cache.NewSession(ctx)
+	options := tests.DefaultOptions()
+	options.TempModfile = false
+	options.Env = append(os.Environ(), "GOPACKAGESDRIVER=off", "GOROOT=")
+
+	for _, testdir := range []string{"indirect", "unused"} {
+		t.Run(testdir, func(t *testing.T) {
+			folder, err := copyToTempDir(filepath.Join("testdata", testdir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(folder)
+			want, err := wantDiagnostics(folder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, snapshot, err := session.NewView(ctx, "diagnostics_test", span.FileURI(folder), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			realfh := soleModFile(ctx, t, snapshot)
+			if hasTempModfile(ctx, snapshot, realfh) {
+				t.Fatal("expected no temp modfile when options.TempModfile is false")
+			}
+			reports, err := mod.Diagnostics(ctx, snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reports) != 1 {
+				t.Errorf("expected 1 fileIdentity, got %d", len(reports))
 			}
-			for fh, got := range reports {
-				if diff := tests.DiffDiagnostics(fh.URI, tt.want, got); diff != "" {
+			for identity, got := range reports {
+				if diff := tests.DiffDiagnostics(identity.URI, want, got); diff != "" {
 					t.Error(diff)
 				}
 			}
@@ -169,8 +230,143 @@ func TestDiagnostics(t *testing.T) {
 	}
 }
 
-func hasTempModfile(ctx context.Context, snapshot source.Snapshot) bool {
-	_, t, _ := snapshot.ModFiles(ctx)
+// TestSuggestedFixes checks that SuggestedFixes returns a single edit for the
+// "unused" and "indirect" diagnostics, and that the edit's new text no longer
+// requires golang.org/x/tools, or no longer marks it as indirect.
+func TestSuggestedFixes(t *testing.T) {
+	ctx := tests.Context(t)
+	cache := cache.New(nil)
+	session := cache.NewSession(ctx)
+	options := tests.DefaultOptions()
+	options.TempModfile = true
+	options.Env = append(os.Environ(), "GOPACKAGESDRIVER=off", "GOROOT=")
+
+	for _, testdir := range []string{"indirect", "unused"} {
+		t.Run(testdir, func(t *testing.T) {
+			folder, err := copyToTempDir(filepath.Join("testdata", testdir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(folder)
+			_, snapshot, err := session.NewView(ctx, "diagnostics_test", span.FileURI(folder), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			realfh := soleModFile(ctx, t, snapshot)
+			if !hasTempModfile(ctx, snapshot, realfh) {
+				return
+			}
+			reports, err := mod.Diagnostics(ctx, snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for identity, diagnostics := range reports {
+				edits, err := mod.SuggestedFixes(ctx, snapshot, realfh, diagnostics)
+				if err != nil {
+					t.Fatal(err)
+				}
+				applied, ok := edits[identity.URI]
+				if !ok {
+					t.Fatalf("no suggested fix for %s", identity.URI)
+				}
+				if len(applied) != 1 {
+					t.Fatalf("expected a single text edit, got %d", len(applied))
+				}
+				switch testdir {
+				case "unused":
+					if strings.Contains(applied[0].NewText, "golang.org/x/tools") {
+						t.Errorf("expected fixed go.mod to no longer require golang.org/x/tools, got %q", applied[0].NewText)
+					}
+				case "indirect":
+					if strings.Contains(applied[0].NewText, "// indirect") {
+						t.Errorf("expected fixed go.mod to no longer mark golang.org/x/tools as indirect, got %q", applied[0].NewText)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestMissingDependencyDiagnostics checks that an import of a module not
+// present in go.mod is reported on the importing .go file, and that the
+// accompanying suggested fix adds the missing require to go.mod.
+func TestMissingDependencyDiagnostics(t *testing.T) {
+	ctx := tests.Context(t)
+	cache := cache.New(nil)
+	session := cache.NewSession(ctx)
+	options := tests.DefaultOptions()
+	options.TempModfile = true
+	options.Env = append(os.Environ(), "GOPACKAGESDRIVER=off", "GOROOT=")
+
+	for _, testdir := range []string{"missingdep", "missingdep_indirect"} {
+		t.Run(testdir, func(t *testing.T) {
+			folder, err := copyToTempDir(filepath.Join("testdata", testdir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(folder)
+			_, snapshot, err := session.NewView(ctx, "diagnostics_test", span.FileURI(folder), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			realfh := soleModFile(ctx, t, snapshot)
+			if !hasTempModfile(ctx, snapshot, realfh) {
+				return
+			}
+			reports, err := mod.Diagnostics(ctx, snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var found bool
+			var diagnostics []source.Diagnostic
+			for identity, got := range reports {
+				if strings.HasSuffix(identity.URI.Filename(), ".mod") {
+					continue
+				}
+				for _, d := range got {
+					if d.Message == "golang.org/x/tools is not in your go.mod file." {
+						found = true
+					}
+				}
+				diagnostics = append(diagnostics, got...)
+			}
+			if !found {
+				t.Fatalf("expected a missing dependency diagnostic on a .go file, got %v", reports)
+			}
+			edits, err := mod.SuggestedFixes(ctx, snapshot, realfh, diagnostics)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sawFix bool
+			for _, fixes := range edits {
+				for _, fix := range fixes {
+					if strings.Contains(fix.NewText, "golang.org/x/tools") {
+						sawFix = true
+					}
+				}
+			}
+			if !sawFix {
+				t.Errorf("expected a suggested fix that requires golang.org/x/tools, got %v", edits)
+			}
+		})
+	}
+}
+
+// soleModFile returns the single go.mod FileHandle for a snapshot whose
+// workspace contains exactly one module, failing the test otherwise.
+func soleModFile(ctx context.Context, t *testing.T, snapshot source.Snapshot) source.FileHandle {
+	realfhs, err := snapshot.ModFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(realfhs) != 1 {
+		t.Fatalf("expected 1 go.mod file, got %d", len(realfhs))
+	}
+	return realfhs[0]
+}
+
+func hasTempModfile(ctx context.Context, snapshot source.Snapshot, realfh source.FileHandle) bool {
+	t, _ := snapshot.TempModFile(ctx, realfh)
 	return t != nil
 }
 
@@ -182,32 +378,41 @@ func copyToTempDir(folder string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	fds, err := ioutil.ReadDir(folder)
-	if err != nil {
+	if err := copyDir(folder, dst); err != nil {
 		return "", err
 	}
+	return dst, nil
+}
+
+// copyDir recursively copies the regular files and subdirectories under src
+// into dst, which must already exist.
+func copyDir(src, dst string) error {
+	fds, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
 	for _, fd := range fds {
-		srcfp := path.Join(folder, fd.Name())
+		srcfp := path.Join(src, fd.Name())
 		dstfp := path.Join(dst, fd.Name())
-		stat, err := os.Stat(srcfp)
-		if err != nil {
-			return "", err
+		if fd.IsDir() {
+			if err := os.Mkdir(dstfp, fd.Mode()); err != nil {
+				return err
+			}
+			if err := copyDir(srcfp, dstfp); err != nil {
+				return err
+			}
+			continue
 		}
-		if !stat.Mode().IsRegular() {
-			return "", fmt.Errorf("cannot copy non regular file %s", srcfp)
+		if !fd.Mode().IsRegular() {
+			return fmt.Errorf("cannot copy non regular file %s", srcfp)
 		}
 		contents, err := ioutil.ReadFile(srcfp)
 		if err != nil {
-			return "", err
+			return err
+		}
+		if err := ioutil.WriteFile(dstfp, contents, fd.Mode()); err != nil {
+			return err
 		}
-		ioutil.WriteFile(dstfp, contents, stat.Mode())
-	}
-	return dst, nil
-}
-
-func getPos(line, character int) protocol.Position {
-	return protocol.Position{
-		Line:      float64(line),
-		Character: float64(character),
 	}
+	return nil
 }
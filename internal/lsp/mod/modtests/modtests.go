@@ -0,0 +1,191 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package modtests supports marker-based tests for go.mod diagnostics and
+// code actions, in the spirit of the marker support used to drive
+// lsp_test.go. Rather than hard coding expected positions as line/column
+// pairs, a testdata go.mod file can annotate itself with //@diag and
+// //@suggestedfix markers, and the test driver extracts its expectations
+// directly from the file.
+//
+// A marker applies to the nearest preceding non-blank, non-marker line: it
+// may either trail that line as an end-of-line comment, or appear alone on
+// the line immediately below it, whichever reads more naturally in the
+// go.mod file being annotated.
+//
+//	require golang.org/x/tools v0.0.0-00010101000000-000000000000 // indirect
+//	//@diag("golang.org/x/tools", "go mod tidy", "should not be an indirect dependency", "warning")
+//
+// Unlike Go source, a go.mod file is parsed by golang.org/x/mod/modfile into
+// token positions rather than AST nodes, so there is no node for a marker to
+// attach itself to; positions are recovered from the raw file text instead.
+package modtests
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/internal/lsp/protocol"
+)
+
+// Diag is the expectation produced by a //@diag(...) marker.
+type Diag struct {
+	Range    protocol.Range
+	Message  string
+	Source   string
+	Severity protocol.DiagnosticSeverity
+}
+
+// SuggestedFix is the expectation produced by a //@suggestedfix(...) marker:
+// applying the fix to the range it annotates should produce Want.
+type SuggestedFix struct {
+	Range protocol.Range
+	Want  string
+}
+
+// markerRe matches a //@name(args) marker, capturing the name and the
+// unparsed, comma-separated argument list.
+var markerRe = regexp.MustCompile(`//@(\w+)\((.*)\)\s*$`)
+
+// argRe extracts double-quoted arguments, allowing escaped quotes.
+var argRe = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"`)
+
+// Parse scans content for //@diag and //@suggestedfix markers and returns
+// the expectations they describe.
+func Parse(content []byte) ([]Diag, []SuggestedFix, error) {
+	index := newLineIndex(content)
+	lines := strings.Split(string(content), "\n")
+
+	var diags []Diag
+	var fixes []SuggestedFix
+	lastContentLine := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		isMarkerOnlyLine := strings.HasPrefix(trimmed, "//@")
+		if trimmed != "" && !isMarkerOnlyLine {
+			lastContentLine = i
+		}
+		idx := strings.Index(line, "//@")
+		if idx < 0 {
+			continue
+		}
+		target := i
+		if isMarkerOnlyLine {
+			if lastContentLine < 0 {
+				return nil, nil, fmt.Errorf("line %d: marker has no preceding line to annotate", i+1)
+			}
+			target = lastContentLine
+		}
+		rng := index.rangeForStatement(lines[target], target)
+		name, args, err := parseMarker(line[idx:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		switch name {
+		case "diag":
+			d, err := newDiag(rng, args)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			diags = append(diags, d)
+		case "suggestedfix":
+			if len(args) != 1 {
+				return nil, nil, fmt.Errorf("line %d: @suggestedfix takes 1 argument, got %d", i+1, len(args))
+			}
+			fixes = append(fixes, SuggestedFix{Range: rng, Want: args[0]})
+		default:
+			return nil, nil, fmt.Errorf("line %d: unknown marker @%s", i+1, name)
+		}
+	}
+	return diags, fixes, nil
+}
+
+func parseMarker(marker string) (string, []string, error) {
+	matches := markerRe.FindStringSubmatch(marker)
+	if matches == nil {
+		return "", nil, fmt.Errorf("malformed marker %q", marker)
+	}
+	name := matches[1]
+	var args []string
+	for _, m := range argRe.FindAllStringSubmatch(matches[2], -1) {
+		args = append(args, strings.ReplaceAll(m[1], `\"`, `"`))
+	}
+	return name, args, nil
+}
+
+func newDiag(rng protocol.Range, args []string) (Diag, error) {
+	if len(args) != 4 {
+		return Diag{}, fmt.Errorf("@diag takes 4 arguments, got %d", len(args))
+	}
+	modPath, source, message, severity := args[0], args[1], args[2], args[3]
+	if modPath != "" {
+		message = fmt.Sprintf("%s %s.", modPath, message)
+	}
+	sev, err := parseSeverity(severity)
+	if err != nil {
+		return Diag{}, err
+	}
+	return Diag{
+		Range:    rng,
+		Message:  message,
+		Source:   source,
+		Severity: sev,
+	}, nil
+}
+
+func parseSeverity(s string) (protocol.DiagnosticSeverity, error) {
+	switch s {
+	case "error":
+		return protocol.SeverityError, nil
+	case "warning":
+		return protocol.SeverityWarning, nil
+	case "hint":
+		return protocol.SeverityHint, nil
+	case "information":
+		return protocol.SeverityInformation, nil
+	}
+	return 0, fmt.Errorf("unknown severity %q", s)
+}
+
+// lineIndex maps byte offsets within a file to protocol.Positions, since the
+// go.mod parser hands back token positions (line/column pairs) rather than
+// AST nodes we could otherwise anchor a marker's range to.
+type lineIndex struct {
+	lineStart []int // byte offset of the start of each line
+}
+
+func newLineIndex(content []byte) *lineIndex {
+	idx := &lineIndex{lineStart: []int{0}}
+	for i, b := range content {
+		if b == '\n' {
+			idx.lineStart = append(idx.lineStart, i+1)
+		}
+	}
+	return idx
+}
+
+// position translates a byte offset within the file into a protocol.Position.
+func (idx *lineIndex) position(offset int) protocol.Position {
+	line := sort.Search(len(idx.lineStart), func(i int) bool { return idx.lineStart[i] > offset }) - 1
+	return protocol.Position{Line: float64(line), Character: float64(offset - idx.lineStart[line])}
+}
+
+// rangeForStatement returns the range covering the non-comment contents of
+// the given (0-indexed) line.
+func (idx *lineIndex) rangeForStatement(text string, line int) protocol.Range {
+	stmt := text
+	if i := strings.Index(stmt, "//"); i >= 0 {
+		stmt = stmt[:i]
+	}
+	trimmedLeft := strings.TrimLeft(stmt, " \t")
+	start := len(stmt) - len(trimmedLeft)
+	trimmed := strings.TrimRight(trimmedLeft, " \t\r")
+	base := idx.lineStart[line]
+	return protocol.Range{
+		Start: idx.position(base + start),
+		End:   idx.position(base + start + len(trimmed)),
+	}
+}
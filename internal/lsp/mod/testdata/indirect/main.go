@@ -0,0 +1,5 @@
+package main
+
+import _ "golang.org/x/tools/internal/lsp/mod"
+
+func main() {}
@@ -0,0 +1,7 @@
+package main
+
+import (
+	_ "golang.org/x/tools/internal/lsp/mod"
+)
+
+func main() {}
@@ -0,0 +1,5 @@
+package main
+
+import _ "mod.com/pkg"
+
+func main() {}
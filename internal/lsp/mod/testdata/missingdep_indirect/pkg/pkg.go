@@ -0,0 +1,6 @@
+// Package pkg imports golang.org/x/tools without mod.com requiring it, so
+// that the module-wide missing-dependency scan has to look past main.go to
+// find the offending import.
+package pkg
+
+import _ "golang.org/x/tools/internal/lsp/mod"
@@ -0,0 +1,8 @@
+// Package main uses golang.org/x/tools, unlike the outer module's go.mod in
+// ../go.mod, so that a nested-module test can assert this module's require
+// isn't flagged unused by the outer module's unrelated diagnostic.
+package main
+
+import _ "golang.org/x/tools/internal/lsp/mod"
+
+func main() {}